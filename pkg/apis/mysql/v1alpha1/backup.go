@@ -17,6 +17,8 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"fmt"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	//	"github.com/presslabs/mysql-operator/pkg/util/options"
 )
@@ -36,3 +38,27 @@ func (c *MysqlBackup) AsOwnerReference() metav1.OwnerReference {
 func (c *MysqlBackup) GetHelperImage() string {
 	return opt.HelperImage
 }
+
+// GetBackupURL returns the rclone remote path this backup is (or will be)
+// stored at, falling back to the cluster's BackupStorage when the backup
+// itself doesn't override it.
+func (c *MysqlBackup) GetBackupURL(cluster *MysqlCluster) (string, error) {
+	storage := &c.Spec.BackupStorage
+	if storage.Provider == "" {
+		storage = &cluster.Spec.BackupStorage
+	}
+
+	remote, err := storage.RemotePath(cluster.Name)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/%s.xbstream.gz", remote, c.Name), nil
+}
+
+// MarkRestored records that this backup's restore finished successfully up
+// to gtid, at the given time.
+func (c *MysqlBackup) MarkRestored(gtid string, at metav1.Time) {
+	c.Status.RestoredToGTID = gtid
+	c.Status.RestoredAt = &at
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+
+	core "k8s.io/api/core/v1"
+)
+
+// BackupStorageProvider discriminates which field of BackupStorage is set.
+type BackupStorageProvider string
+
+const (
+	// BackupStorageS3 stores backups in an S3-compatible bucket.
+	BackupStorageS3 BackupStorageProvider = "S3"
+	// BackupStorageGCS stores backups in a Google Cloud Storage bucket.
+	BackupStorageGCS BackupStorageProvider = "GCS"
+	// BackupStorageAzure stores backups in an Azure Blob Storage container.
+	BackupStorageAzure BackupStorageProvider = "Azure"
+	// BackupStorageJuiceFS stores backups on a JuiceFS volume, useful for
+	// sharing a filesystem-backed store across clusters.
+	BackupStorageJuiceFS BackupStorageProvider = "JuiceFS"
+)
+
+// BackupStorage configures where backups for a cluster are kept. It's a
+// discriminated union: Provider selects which of the provider-specific
+// fields below is read, the same way core.VolumeSource works.
+type BackupStorage struct {
+	// Provider selects the backend. One of S3, GCS, Azure, JuiceFS.
+	Provider BackupStorageProvider `json:"provider"`
+
+	// SecretRef points at the Secret holding the provider's credentials.
+	SecretRef *core.LocalObjectReference `json:"secretRef,omitempty"`
+
+	// +optional
+	S3 *S3BackupStorage `json:"s3,omitempty"`
+	// +optional
+	GCS *GCSBackupStorage `json:"gcs,omitempty"`
+	// +optional
+	Azure *AzureBackupStorage `json:"azure,omitempty"`
+	// +optional
+	JuiceFS *JuiceFSBackupStorage `json:"juicefs,omitempty"`
+
+	// Retention is the pruning policy applied to objects under this
+	// storage's path. A zero value disables pruning.
+	// +optional
+	Retention BackupRetentionPolicy `json:"retention,omitempty"`
+}
+
+// S3BackupStorage configures an S3 (or S3-compatible) remote. Credentials
+// are read from BackupStorage.SecretRef's AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY keys.
+type S3BackupStorage struct {
+	Bucket string `json:"bucket"`
+	Region string `json:"region,omitempty"`
+	// Endpoint overrides the default AWS endpoint, for S3-compatible
+	// providers (MinIO, DigitalOcean Spaces, etc).
+	Endpoint string `json:"endpoint,omitempty"`
+	// PathStyle forces path-style bucket addressing instead of
+	// virtual-hosted style, required by most S3-compatible providers.
+	PathStyle bool `json:"pathStyle,omitempty"`
+	// SSECustomerKeyRef references a Secret holding a key for server-side
+	// encryption with customer-provided keys. The rclone config that
+	// apptakebackup.BuildRcloneConfig renders does not read this field, so
+	// setting it does not enable encryption.
+	SSECustomerKeyRef *core.LocalObjectReference `json:"sseCustomerKeyRef,omitempty"`
+}
+
+// GCSBackupStorage configures a Google Cloud Storage remote. Credentials
+// are read from BackupStorage.SecretRef's SERVICE_ACCOUNT_JSON key.
+type GCSBackupStorage struct {
+	Bucket string `json:"bucket"`
+}
+
+// AzureBackupStorage configures an Azure Blob Storage remote. Credentials
+// are read from BackupStorage.SecretRef's AZURE_ACCOUNT/AZURE_KEY keys.
+type AzureBackupStorage struct {
+	Container string `json:"container"`
+}
+
+// JuiceFSBackupStorage configures a JuiceFS-backed remote, for sharing a
+// filesystem-like store across clusters without an object-store bill.
+// Credentials are read from BackupStorage.SecretRef's JFS_TOKEN key, if set.
+type JuiceFSBackupStorage struct {
+	// MetaURL is the JuiceFS metadata engine URL (e.g. redis://host:6379/1).
+	MetaURL string `json:"metaUrl"`
+	// SubPath is prefixed onto every object key, letting multiple clusters
+	// share one JuiceFS volume.
+	SubPath string `json:"subPath,omitempty"`
+}
+
+// BackupRetentionPolicy bounds how many backups (and for how long) are kept
+// for a given BackupStorage. Whichever bound is hit first wins.
+type BackupRetentionPolicy struct {
+	// Count is the number of most-recent backups to keep. Zero means
+	// unbounded.
+	Count int `json:"count,omitempty"`
+	// MaxAge is the maximum age of a kept backup, as a duration string
+	// (e.g. "720h"). Empty means unbounded.
+	MaxAge string `json:"maxAge,omitempty"`
+}
+
+// RemotePath returns the rclone remote path backups for cluster
+// clusterName are written under.
+func (s *BackupStorage) RemotePath(clusterName string) (string, error) {
+	switch s.Provider {
+	case BackupStorageS3:
+		if s.S3 == nil {
+			return "", fmt.Errorf("backupStorage: provider is S3 but s3 config is nil")
+		}
+		return fmt.Sprintf("backup-remote:%s/%s", s.S3.Bucket, clusterName), nil
+	case BackupStorageGCS:
+		if s.GCS == nil {
+			return "", fmt.Errorf("backupStorage: provider is GCS but gcs config is nil")
+		}
+		return fmt.Sprintf("backup-remote:%s/%s", s.GCS.Bucket, clusterName), nil
+	case BackupStorageAzure:
+		if s.Azure == nil {
+			return "", fmt.Errorf("backupStorage: provider is Azure but azure config is nil")
+		}
+		return fmt.Sprintf("backup-remote:%s/%s", s.Azure.Container, clusterName), nil
+	case BackupStorageJuiceFS:
+		if s.JuiceFS == nil {
+			return "", fmt.Errorf("backupStorage: provider is JuiceFS but juicefs config is nil")
+		}
+		base := fmt.Sprintf("backup-remote:%s", clusterName)
+		if len(s.JuiceFS.SubPath) != 0 {
+			base = fmt.Sprintf("backup-remote:%s/%s", s.JuiceFS.SubPath, clusterName)
+		}
+		return base, nil
+	default:
+		return "", fmt.Errorf("backupStorage: unknown provider %q", s.Provider)
+	}
+}
@@ -144,6 +144,44 @@ func (c *ClusterSpec) GetOrcUri() string {
 	return opt.OrchestratorUri
 }
 
+// defaultMaxSecondsBehindMaster is used when ClusterSpec.MaxSecondsBehindMaster
+// is left unset.
+const defaultMaxSecondsBehindMaster = 5
+
+// GetMaxSecondsBehindMaster returns the replication lag threshold used by
+// the Healthy condition, defaulting to 5s when the cluster doesn't
+// configure one.
+func (c *ClusterSpec) GetMaxSecondsBehindMaster() int64 {
+	if c.MaxSecondsBehindMaster <= 0 {
+		return defaultMaxSecondsBehindMaster
+	}
+	return c.MaxSecondsBehindMaster
+}
+
+// defaultPollIntervalSeconds is used when ClusterSpec.PollIntervalSeconds is
+// left unset.
+const defaultPollIntervalSeconds = 10
+
+// GetPollIntervalSeconds returns how often the cluster manager polls this
+// cluster's runtime health, defaulting to 10s when the cluster doesn't tune
+// it explicitly.
+func (c *ClusterSpec) GetPollIntervalSeconds() int32 {
+	if c.PollIntervalSeconds <= 0 {
+		return defaultPollIntervalSeconds
+	}
+	return c.PollIntervalSeconds
+}
+
+// GetReplicas returns the configured replica count, defaulting to 1 when
+// ClusterSpec.Replicas is unset, the same default the StatefulSet itself falls
+// back to.
+func (c *ClusterSpec) GetReplicas() int32 {
+	if c.Replicas == nil {
+		return 1
+	}
+	return *c.Replicas
+}
+
 // GetMysqlImage returns mysql image, composed from oprions and  Spec.MysqlVersion
 func (c *ClusterSpec) GetMysqlImage() string {
 	return opt.MysqlImage + ":" + c.MysqlVersion
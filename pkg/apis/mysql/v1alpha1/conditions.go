@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterConditionType discriminates the conditions reported on
+// MysqlCluster.Status.Conditions.
+type ClusterConditionType string
+
+const (
+	// ClusterConditionAvailable is True when a majority of the cluster's
+	// pods are reachable and orchestrator has a master elected.
+	ClusterConditionAvailable ClusterConditionType = "Available"
+	// ClusterConditionHealthy is True when every replica's replication lag
+	// is within the configured threshold.
+	ClusterConditionHealthy ClusterConditionType = "Healthy"
+	// ClusterConditionStatefulSetReady is True when the StatefulSet's
+	// observed generation matches its spec generation and the rolling
+	// update has completed.
+	ClusterConditionStatefulSetReady ClusterConditionType = "StatefulSetReady"
+	// ClusterConditionReconcileSuccess is True when the last cFactory.Sync
+	// call returned without error.
+	ClusterConditionReconcileSuccess ClusterConditionType = "ReconcileSuccess"
+	// ClusterConditionPITRWindow is True when the cluster has at least one
+	// retained binlog segment, and carries the oldest recoverable
+	// timestamp in its Message.
+	ClusterConditionPITRWindow ClusterConditionType = "PITRWindow"
+)
+
+// BackupConditionType discriminates the conditions reported on
+// MysqlBackup.Status.Conditions.
+type BackupConditionType string
+
+const (
+	// BackupConditionReconcileSuccess is True when the last reconcile of
+	// the backup resource completed without error.
+	BackupConditionReconcileSuccess BackupConditionType = "ReconcileSuccess"
+)
+
+// SetClusterCondition updates (or appends) the condition of the given type
+// on the cluster status, following meta.SetStatusCondition semantics:
+// LastTransitionTime only moves forward when the status actually changes.
+func SetClusterCondition(status *MysqlClusterStatus, conditionType ClusterConditionType,
+	conditionStatus metav1.ConditionStatus, reason, message string, observedGeneration int64) {
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               string(conditionType),
+		Status:             conditionStatus,
+		ObservedGeneration: observedGeneration,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// GetClusterCondition returns the condition of the given type, or nil if it
+// hasn't been reported yet.
+func GetClusterCondition(status *MysqlClusterStatus, conditionType ClusterConditionType) *metav1.Condition {
+	return meta.FindStatusCondition(status.Conditions, string(conditionType))
+}
+
+// SetBackupCondition updates (or appends) the condition of the given type on
+// the backup status.
+func SetBackupCondition(status *MysqlBackupStatus, conditionType BackupConditionType,
+	conditionStatus metav1.ConditionStatus, reason, message string, observedGeneration int64) {
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               string(conditionType),
+		Status:             conditionStatus,
+		ObservedGeneration: observedGeneration,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// GetBackupCondition returns the condition of the given type, or nil if it
+// hasn't been reported yet.
+func GetBackupCondition(status *MysqlBackupStatus, conditionType BackupConditionType) *metav1.Condition {
+	return meta.FindStatusCondition(status.Conditions, string(conditionType))
+}
+
+// setDataScriptCondition updates (or appends) the condition of the given
+// type on a MysqlDataScript status.
+func setDataScriptCondition(status *MysqlDataScriptStatus, conditionType DataScriptConditionType,
+	conditionStatus metav1.ConditionStatus, reason, message string, observedGeneration int64) {
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               string(conditionType),
+		Status:             conditionStatus,
+		ObservedGeneration: observedGeneration,
+		Reason:             reason,
+		Message:            message,
+	})
+}
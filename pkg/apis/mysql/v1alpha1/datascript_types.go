@@ -0,0 +1,210 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MysqlDataScriptKind is the CRD kind for MysqlDataScript.
+const MysqlDataScriptKind = "MysqlDataScript"
+
+// MysqlDataScriptTarget selects which host(s) a MysqlDataScript runs against.
+type MysqlDataScriptTarget string
+
+const (
+	// TargetMaster runs the script against the cluster's current master.
+	TargetMaster MysqlDataScriptTarget = "master"
+	// TargetAllReplicas runs the script against every ready pod (pods 0 to
+	// Status.ReadyNodes-1, the master included), one Job per pod, with all
+	// Jobs launched together.
+	TargetAllReplicas MysqlDataScriptTarget = "all-replicas"
+	// TargetRandomReplica runs the script against one healthy replica.
+	TargetRandomReplica MysqlDataScriptTarget = "random-replica"
+)
+
+// DataScriptConditionType discriminates the conditions reported on
+// MysqlDataScript.Status.Conditions.
+type DataScriptConditionType string
+
+const (
+	DataScriptConditionProgressing DataScriptConditionType = "Progressing"
+	DataScriptConditionSucceeded   DataScriptConditionType = "Succeeded"
+	DataScriptConditionFailed      DataScriptConditionType = "Failed"
+)
+
+// defaultMaxStatements caps how many statements a single MysqlDataScript may
+// run when Spec.MaxStatements is left unset.
+const defaultMaxStatements = 100
+
+// MysqlDataScript declares a one-shot SQL script to run against a
+// MysqlCluster, for GitOps-friendly migrations and admin queries.
+type MysqlDataScript struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MysqlDataScriptSpec   `json:"spec"`
+	Status MysqlDataScriptStatus `json:"status,omitempty"`
+}
+
+// MysqlDataScriptList is a list of MysqlDataScript resources.
+type MysqlDataScriptList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []MysqlDataScript `json:"items"`
+}
+
+// MysqlDataScriptSpec is the desired state of a MysqlDataScript.
+type MysqlDataScriptSpec struct {
+	// ClusterName is the MysqlCluster this script runs against.
+	ClusterName string `json:"clusterName"`
+
+	// Script is the inline SQL to run. Exactly one of Script, ConfigMapRef
+	// or SecretRef must be set.
+	// +optional
+	Script string `json:"script,omitempty"`
+	// +optional
+	ConfigMapRef *core.LocalObjectReference `json:"configMapRef,omitempty"`
+	// +optional
+	SecretRef *core.LocalObjectReference `json:"secretRef,omitempty"`
+
+	// Target selects which host(s) the script runs against. Defaults to master.
+	// +optional
+	Target MysqlDataScriptTarget `json:"target,omitempty"`
+
+	// Database is used to `USE` before running the script, if set.
+	// +optional
+	Database string `json:"database,omitempty"`
+
+	// AllowDestructive must be set to run scripts containing DROP DATABASE.
+	// +optional
+	AllowDestructive bool `json:"allowDestructive,omitempty"`
+
+	// MaxStatements caps how many statements the script may contain.
+	// Defaults to 100.
+	// +optional
+	MaxStatements int `json:"maxStatements,omitempty"`
+
+	// TTLSecondsAfterFinished is forwarded to the underlying Job so
+	// completed/failed runs are garbage collected.
+	// +optional
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+}
+
+// GetMaxStatements returns Spec.MaxStatements, or the default cap if unset.
+func (s *MysqlDataScriptSpec) GetMaxStatements() int {
+	if s.MaxStatements <= 0 {
+		return defaultMaxStatements
+	}
+	return s.MaxStatements
+}
+
+// GetTarget returns Spec.Target, defaulting to master.
+func (s *MysqlDataScriptSpec) GetTarget() MysqlDataScriptTarget {
+	if len(s.Target) == 0 {
+		return TargetMaster
+	}
+	return s.Target
+}
+
+// ValidateStatements rejects scripts over the statement cap, and (unless
+// AllowDestructive is set) scripts containing a DROP DATABASE statement.
+func (s *MysqlDataScriptSpec) ValidateStatements(statements []string) error {
+	if len(statements) > s.GetMaxStatements() {
+		return &DataScriptValidationError{Reason: "TooManyStatements"}
+	}
+
+	if s.AllowDestructive {
+		return nil
+	}
+
+	for _, stmt := range statements {
+		if strings.Contains(strings.ToUpper(stmt), "DROP DATABASE") {
+			return &DataScriptValidationError{Reason: "DestructiveStatementRejected"}
+		}
+	}
+
+	return nil
+}
+
+// DataScriptValidationError is returned by ValidateStatements.
+type DataScriptValidationError struct {
+	Reason string
+}
+
+func (e *DataScriptValidationError) Error() string {
+	return "datascript: " + e.Reason
+}
+
+// StatementOutcome records the result of running a single SQL statement.
+type StatementOutcome struct {
+	Statement string `json:"statement"`
+	Succeeded bool   `json:"succeeded"`
+	// +optional
+	Error string `json:"error,omitempty"`
+	// +optional
+	RowsAffected int64 `json:"rowsAffected,omitempty"`
+	// Result is a truncated, JSON-encoded result set, for SELECTs.
+	// +optional
+	Result string `json:"result,omitempty"`
+}
+
+// MysqlDataScriptExecution records one run of the script against one host.
+type MysqlDataScriptExecution struct {
+	Host      string      `json:"host"`
+	StartedAt metav1.Time `json:"startedAt"`
+	// +optional
+	FinishedAt *metav1.Time `json:"finishedAt,omitempty"`
+	// +optional
+	Statements []StatementOutcome `json:"statements,omitempty"`
+}
+
+// MysqlDataScriptStatus is the observed state of a MysqlDataScript.
+type MysqlDataScriptStatus struct {
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// +optional
+	Executions []MysqlDataScriptExecution `json:"executions,omitempty"`
+}
+
+// AsOwnerReference returns the MysqlDataScript owner reference.
+func (s *MysqlDataScript) AsOwnerReference() metav1.OwnerReference {
+	trueVar := true
+	return metav1.OwnerReference{
+		APIVersion: SchemeGroupVersion.String(),
+		Kind:       MysqlDataScriptKind,
+		Name:       s.Name,
+		UID:        s.UID,
+		Controller: &trueVar,
+	}
+}
+
+// GetHelperImage return helper image from options.
+func (s *MysqlDataScript) GetHelperImage() string {
+	return opt.HelperImage
+}
+
+// SetCondition updates (or appends) the condition of the given type on the
+// data script status.
+func (s *MysqlDataScript) SetCondition(conditionType DataScriptConditionType,
+	status metav1.ConditionStatus, reason, message string) {
+	setDataScriptCondition(&s.Status, conditionType, status, reason, message, s.Generation)
+}
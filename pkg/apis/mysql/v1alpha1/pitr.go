@@ -0,0 +1,113 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// binlogPrefix is the path segment binlog segments are stored under,
+// relative to the cluster's backup remote.
+const binlogPrefix = "binlog"
+
+// BinlogShipperSpec enables continuous binlog shipping for point-in-time
+// recovery. Segments are tailed from the current master and streamed,
+// gzipped, to the cluster's BackupStorage under a "<cluster>/binlog/" prefix.
+type BinlogShipperSpec struct {
+	// Enabled turns binlog shipping on for the cluster.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// RotateBytes is the uncompressed size at which a segment is rotated
+	// and flushed to storage. Defaults to 128MiB.
+	// +optional
+	RotateBytes int64 `json:"rotateBytes,omitempty"`
+}
+
+// GetRotateBytes returns RotateBytes, or the default if unset.
+func (b *BinlogShipperSpec) GetRotateBytes() int64 {
+	if b.RotateBytes <= 0 {
+		return 128 * MB
+	}
+	return b.RotateBytes
+}
+
+// RestoreTargetKind discriminates which field of RestoreTarget is set.
+type RestoreTargetKind string
+
+const (
+	// RestoreTargetLatestFull restores the newest full backup, replaying
+	// no binlogs.
+	RestoreTargetLatestFull RestoreTargetKind = "LatestFull"
+	// RestoreTargetTimestamp restores to the given point in time.
+	RestoreTargetTimestamp RestoreTargetKind = "Timestamp"
+	// RestoreTargetGTID restores up to (and including) the given GTID set.
+	RestoreTargetGTID RestoreTargetKind = "GTID"
+)
+
+// RestoreTarget selects what point a MysqlBackup restore should recover to.
+type RestoreTarget struct {
+	// Kind selects which of Timestamp/GTID is read. Defaults to LatestFull.
+	Kind RestoreTargetKind `json:"kind,omitempty"`
+
+	// +optional
+	Timestamp *metav1.Time `json:"timestamp,omitempty"`
+	// +optional
+	GTID string `json:"gtid,omitempty"`
+
+	// Host is the mysqld instance the restored backup and binlogs are
+	// replayed into. It must be a fresh instance, not a cluster's live
+	// master: replaying historical statements onto an already-running
+	// master would reapply transactions it has already executed.
+	Host string `json:"host"`
+}
+
+// BinlogSegmentPath returns the remote path a shipped binlog segment
+// covering [fromGTID, toGTID] should be written to.
+func BinlogSegmentPath(storage *BackupStorage, clusterName, fromGTID, toGTID string) (string, error) {
+	remote, err := storage.RemotePath(clusterName)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/%s-%s.bin.gz", remote, binlogPrefix, fromGTID, toGTID), nil
+}
+
+// BinlogPrefix returns the remote directory shipped binlog segments for
+// clusterName are kept under, for listing during a restore or when
+// computing the PITR window.
+func BinlogPrefix(storage *BackupStorage, clusterName string) (string, error) {
+	remote, err := storage.RemotePath(clusterName)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", remote, binlogPrefix), nil
+}
+
+// UpdatePITRWindowCondition sets the PITRWindow condition from the oldest
+// retained binlog segment's timestamp. A nil oldestSegment means no
+// segments are retained yet (binlog shipping just enabled, or disabled).
+func UpdatePITRWindowCondition(status *MysqlClusterStatus, oldestSegment *metav1.Time, generation int64) {
+	if oldestSegment == nil {
+		SetClusterCondition(status, ClusterConditionPITRWindow, metav1.ConditionFalse,
+			"NoRetainedSegments", "no binlog segments are retained yet", generation)
+		return
+	}
+
+	SetClusterCondition(status, ClusterConditionPITRWindow, metav1.ConditionTrue,
+		"SegmentsRetained", fmt.Sprintf("oldest recoverable point is %s", oldestSegment.Format(metav1.RFC3339Micro)), generation)
+}
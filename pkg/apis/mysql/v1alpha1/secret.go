@@ -0,0 +1,236 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Secret key names the operator reads from and writes to the Secret
+// referenced by ClusterSpec.SecretName. Anything left blank by the user is
+// generated on first sync and written back.
+const (
+	RootPassword        = "ROOT_PASSWORD"
+	User                = "USER"
+	Password            = "PASSWORD"
+	Database            = "DATABASE"
+	ReplicationUser     = "REPLICATION_USER"
+	ReplicationPassword = "REPLICATION_PASSWORD"
+	MetricsUser         = "METRICS_USER"
+	MetricsPassword     = "METRICS_PASSWORD"
+	OrcTopologyUser     = "ORC_TOPOLOGY_USER"
+	OrcTopologyPassword = "ORC_TOPOLOGY_PASSWORD"
+)
+
+// generatedSecretKeys lists every password-like key the operator is willing
+// to generate on behalf of the user. RootPassword is included; User,
+// Database and the *_USER keys are identifiers, not secrets, and are left
+// to the user to set.
+var generatedSecretKeys = []string{
+	RootPassword,
+	Password,
+	ReplicationPassword,
+	MetricsPassword,
+	OrcTopologyPassword,
+}
+
+// rotatableSecretKeys is the subset of generatedSecretKeys touched by a
+// RotateCredentials request. RootPassword is deliberately excluded: rotating
+// it requires draining connections cluster-wide, so it's left to a manual,
+// explicit action rather than the annotation-driven flow.
+var rotatableSecretKeys = []string{
+	Password,
+	ReplicationPassword,
+	MetricsPassword,
+	OrcTopologyPassword,
+}
+
+// RotateCredentialsAnnotation, when present (any value) on a MysqlCluster,
+// requests that non-root passwords be regenerated and propagated via
+// ALTER USER. The operator removes the annotation once the rotation completes.
+const RotateCredentialsAnnotation = "mysql.presslabs.org/rotate-credentials"
+
+// CredentialsStatus reports which Secret keys the operator generated, so
+// users know what they still need to manage and what's safe to rotate.
+type CredentialsStatus struct {
+	// GeneratedKeys lists the keys the operator generated because the user
+	// left them blank.
+	// +optional
+	GeneratedKeys []string `json:"generatedKeys,omitempty"`
+	// LastRotatedAt is set whenever RotateCredentials last completed.
+	// +optional
+	LastRotatedAt *metav1.Time `json:"lastRotatedAt,omitempty"`
+}
+
+// GetRootPassword reads ROOT_PASSWORD out of secret.
+func (c *MysqlCluster) GetRootPassword(secret *core.Secret) (string, error) {
+	return readSecretKey(secret, RootPassword)
+}
+
+// GetReplicationCreds reads REPLICATION_USER/REPLICATION_PASSWORD out of secret.
+func (c *MysqlCluster) GetReplicationCreds(secret *core.Secret) (user, password string, err error) {
+	if user, err = readSecretKey(secret, ReplicationUser); err != nil {
+		return "", "", err
+	}
+	if password, err = readSecretKey(secret, ReplicationPassword); err != nil {
+		return "", "", err
+	}
+	return user, password, nil
+}
+
+// GetMetricsCreds reads METRICS_USER/METRICS_PASSWORD out of secret.
+func (c *MysqlCluster) GetMetricsCreds(secret *core.Secret) (user, password string, err error) {
+	if user, err = readSecretKey(secret, MetricsUser); err != nil {
+		return "", "", err
+	}
+	if password, err = readSecretKey(secret, MetricsPassword); err != nil {
+		return "", "", err
+	}
+	return user, password, nil
+}
+
+// GetOrcTopologyCreds reads ORC_TOPOLOGY_USER/ORC_TOPOLOGY_PASSWORD out of secret.
+func (c *MysqlCluster) GetOrcTopologyCreds(secret *core.Secret) (user, password string, err error) {
+	if user, err = readSecretKey(secret, OrcTopologyUser); err != nil {
+		return "", "", err
+	}
+	if password, err = readSecretKey(secret, OrcTopologyPassword); err != nil {
+		return "", "", err
+	}
+	return user, password, nil
+}
+
+func readSecretKey(secret *core.Secret, key string) (string, error) {
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s is missing key %q", secret.Namespace, secret.Name, key)
+	}
+	return string(value), nil
+}
+
+// EnsureSecretKeys fills in any of generatedSecretKeys that secret.Data is
+// missing, using crypto/rand, and returns the keys it generated so the
+// caller can write them back to the Secret and record them in
+// Status.Credentials.
+func EnsureSecretKeys(secret *core.Secret) ([]string, error) {
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+
+	var generated []string
+	for _, key := range generatedSecretKeys {
+		if len(secret.Data[key]) != 0 {
+			continue
+		}
+
+		value, err := randomPassword()
+		if err != nil {
+			return nil, fmt.Errorf("generating %s: %s", key, err)
+		}
+		secret.Data[key] = []byte(value)
+		generated = append(generated, key)
+	}
+
+	return generated, nil
+}
+
+// RotateKeys regenerates the rotatable credentials in secret, unconditionally
+// (the caller is expected to check RotateCredentialsAnnotation first), and
+// returns the keys it rotated.
+func RotateKeys(secret *core.Secret) ([]string, error) {
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+
+	var rotated []string
+	for _, key := range rotatableSecretKeys {
+		value, err := randomPassword()
+		if err != nil {
+			return nil, fmt.Errorf("rotating %s: %s", key, err)
+		}
+		secret.Data[key] = []byte(value)
+		rotated = append(rotated, key)
+	}
+
+	return rotated, nil
+}
+
+// userPasswordPairs maps each account's username key to its password key,
+// for building the ALTER USER statements a rotation issues.
+var userPasswordPairs = [][2]string{
+	{User, Password},
+	{ReplicationUser, ReplicationPassword},
+	{MetricsUser, MetricsPassword},
+	{OrcTopologyUser, OrcTopologyPassword},
+}
+
+// AlterUserStatements builds the `ALTER USER ... IDENTIFIED BY ...`
+// statements needed to apply secret's current passwords in MySQL, for
+// accounts that have both a username and password key set. The caller runs
+// these through the MysqlDataScript path (or an internal equivalent)
+// against the master. Usernames are set by the user (the operator only
+// generates passwords), so both they and the passwords are escaped rather than
+// interpolated raw: a quote, backslash or semicolon in either must not be
+// able to alter the statement's meaning.
+func AlterUserStatements(secret *core.Secret) []string {
+	var statements []string
+	for _, pair := range userPasswordPairs {
+		userKey, passwordKey := pair[0], pair[1]
+		user, password := secret.Data[userKey], secret.Data[passwordKey]
+		if len(user) == 0 || len(password) == 0 {
+			continue
+		}
+		statements = append(statements, fmt.Sprintf(
+			"ALTER USER %s@'%%' IDENTIFIED BY %s", quoteMysqlString(string(user)), quoteMysqlString(string(password))))
+	}
+	return statements
+}
+
+// mysqlStringEscaper escapes the characters that matter inside a MySQL
+// single-quoted string literal: backslash and the quote itself (so a
+// quote can't close the literal early), plus NUL/newline/carriage-return
+// (so each statement stays on one line). Semicolons are left as is: inside
+// the quoted literal MySQL does not treat them as a statement end.
+var mysqlStringEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`'`, `\'`,
+	"\x00", `\0`,
+	"\n", `\n`,
+	"\r", `\r`,
+)
+
+// quoteMysqlString escapes s and wraps it in single quotes, suitable for
+// splicing into a SQL statement built with fmt.Sprintf.
+func quoteMysqlString(s string) string {
+	return "'" + mysqlStringEscaper.Replace(s) + "'"
+}
+
+const randomPasswordBytes = 24
+
+func randomPassword() (string, error) {
+	buf := make([]byte, randomPasswordBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package apptakebackup is the sidecar entrypoint that streams a backup to
+// the cluster's configured BackupStorage.
+package apptakebackup
+
+import (
+	"fmt"
+	"os/exec"
+
+	api "github.com/presslabs/mysql-operator/pkg/apis/mysql/v1alpha1"
+)
+
+// remoteName is the fixed rclone remote name written into the generated
+// config; only one backend is ever configured per backup run.
+const remoteName = "backup-remote"
+
+// BuildRcloneConfig renders an rclone config file section for storage,
+// reading provider credentials out of secret (as produced by
+// k8s.io/api/core/v1.Secret.Data). It returns the ini-formatted config
+// ready to be written to the path passed via `rclone --config`.
+func BuildRcloneConfig(storage *api.BackupStorage, secret map[string][]byte) (string, error) {
+	switch storage.Provider {
+	case api.BackupStorageS3:
+		return buildS3Config(storage.S3, secret)
+	case api.BackupStorageGCS:
+		return buildGCSConfig(secret)
+	case api.BackupStorageAzure:
+		return buildAzureConfig(storage.Azure, secret)
+	case api.BackupStorageJuiceFS:
+		return buildJuiceFSConfig(storage.JuiceFS, secret)
+	default:
+		return "", fmt.Errorf("apptakebackup: unknown backup storage provider %q", storage.Provider)
+	}
+}
+
+func buildS3Config(s3 *api.S3BackupStorage, secret map[string][]byte) (string, error) {
+	if s3 == nil {
+		return "", fmt.Errorf("apptakebackup: s3 storage config is nil")
+	}
+	cfg := fmt.Sprintf("[%s]\ntype = s3\nprovider = Other\naccess_key_id = %s\nsecret_access_key = %s\nregion = %s\n",
+		remoteName, secret["AWS_ACCESS_KEY_ID"], secret["AWS_SECRET_ACCESS_KEY"], s3.Region)
+	if len(s3.Endpoint) != 0 {
+		cfg += fmt.Sprintf("endpoint = %s\n", s3.Endpoint)
+	}
+	if s3.PathStyle {
+		cfg += "force_path_style = true\n"
+	}
+	return cfg, nil
+}
+
+func buildGCSConfig(secret map[string][]byte) (string, error) {
+	return fmt.Sprintf("[%s]\ntype = google cloud storage\nservice_account_credentials = %s\n",
+		remoteName, secret["SERVICE_ACCOUNT_JSON"]), nil
+}
+
+func buildAzureConfig(azure *api.AzureBackupStorage, secret map[string][]byte) (string, error) {
+	if azure == nil {
+		return "", fmt.Errorf("apptakebackup: azure storage config is nil")
+	}
+	return fmt.Sprintf("[%s]\ntype = azureblob\naccount = %s\nkey = %s\n",
+		remoteName, secret["AZURE_ACCOUNT"], secret["AZURE_KEY"]), nil
+}
+
+func buildJuiceFSConfig(jfs *api.JuiceFSBackupStorage, secret map[string][]byte) (string, error) {
+	if jfs == nil {
+		return "", fmt.Errorf("apptakebackup: juicefs storage config is nil")
+	}
+	cfg := fmt.Sprintf("[%s]\ntype = juicefs\nmeta-url = %s\n", remoteName, jfs.MetaURL)
+	if token := secret["JFS_TOKEN"]; len(token) != 0 {
+		cfg += fmt.Sprintf("token = %s\n", token)
+	}
+	return cfg, nil
+}
+
+// StreamBackupCmd builds the `xtrabackup | gzip | rclone rcat` pipeline
+// that streams a full backup to remotePath, using the rclone config at
+// configPath. The caller is responsible for wiring the returned commands'
+// Stdin/Stdout/Stderr and running them as a pipeline.
+func StreamBackupCmd(configPath, remotePath string, xtrabackupArgs []string) (xtrabackup, gzipCmd, rclone *exec.Cmd) {
+	xtrabackup = exec.Command("xtrabackup", xtrabackupArgs...)
+	gzipCmd = exec.Command("gzip")
+	rclone = exec.Command("rclone", "--config", configPath, "rcat", remotePath)
+	return xtrabackup, gzipCmd, rclone
+}
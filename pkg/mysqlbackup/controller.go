@@ -0,0 +1,181 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mysqlbackup reconciles MysqlBackup resources: when
+// Spec.RestoreTarget is set and hasn't been applied yet, it resolves and
+// applies the restore plan against the fresh instance named by
+// Spec.RestoreTarget.Host.
+package mysqlbackup
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	api "github.com/presslabs/mysql-operator/pkg/apis/mysql/v1alpha1"
+	"github.com/presslabs/mysql-operator/pkg/apptakebackup"
+	ticlientset "github.com/presslabs/mysql-operator/pkg/generated/clientset/versioned"
+	"github.com/presslabs/mysql-operator/pkg/mysqlbackup/restore"
+)
+
+// restoreDataDir is where xtrabackup prepares the full backup before binlog
+// segments are replayed on top of it.
+const restoreDataDir = "/var/lib/mysql"
+
+// Interface is for the MysqlBackup factory.
+type Interface interface {
+	// Sync resolves and applies Spec.RestoreTarget, if set and not already
+	// applied.
+	Sync(ctx context.Context) error
+}
+
+// bFactory is the MysqlBackup factory, named to mirror cFactory/dFactory.
+type bFactory struct {
+	backup  *api.MysqlBackup
+	cluster *api.MysqlCluster
+
+	namespace string
+
+	client   kubernetes.Interface
+	myClient ticlientset.Interface
+}
+
+// New creates a new MysqlBackup factory.
+func New(backup *api.MysqlBackup, cluster *api.MysqlCluster, klient kubernetes.Interface,
+	myClient ticlientset.Interface, ns string) Interface {
+	return &bFactory{
+		backup:    backup,
+		cluster:   cluster,
+		client:    klient,
+		myClient:  myClient,
+		namespace: ns,
+	}
+}
+
+func (f *bFactory) Sync(ctx context.Context) error {
+	if url, err := f.backup.GetBackupURL(f.cluster); err != nil {
+		glog.Warningf("[mysqlbackup/%s]: resolving backup URL: %s", f.backup.Name, err)
+	} else {
+		f.backup.Status.BackupURL = url
+	}
+
+	if f.backup.Spec.RestoreTarget == nil || f.backup.Status.RestoredAt != nil {
+		return nil
+	}
+
+	storage := &f.backup.Spec.BackupStorage
+	if storage.Provider == "" {
+		storage = &f.cluster.Spec.BackupStorage
+	}
+	if storage.SecretRef == nil {
+		err := fmt.Errorf("backupStorage.secretRef is unset")
+		api.SetBackupCondition(&f.backup.Status, api.BackupConditionReconcileSuccess,
+			metav1.ConditionFalse, "ConfigInvalid", err.Error(), f.backup.Generation)
+		return err
+	}
+
+	configPath, cleanup, err := f.rcloneConfig(ctx, storage)
+	if err != nil {
+		api.SetBackupCondition(&f.backup.Status, api.BackupConditionReconcileSuccess,
+			metav1.ConditionFalse, "RcloneConfigFailed", err.Error(), f.backup.Generation)
+		return fmt.Errorf("building rclone config: %s", err)
+	}
+	defer cleanup()
+
+	plan, err := restore.Resolve(configPath, storage, f.cluster.Name, *f.backup.Spec.RestoreTarget)
+	if err != nil {
+		api.SetBackupCondition(&f.backup.Status, api.BackupConditionReconcileSuccess,
+			metav1.ConditionFalse, "ResolveFailed", err.Error(), f.backup.Generation)
+		return fmt.Errorf("resolving restore plan: %s", err)
+	}
+
+	target, err := f.targetConn(ctx)
+	if err != nil {
+		api.SetBackupCondition(&f.backup.Status, api.BackupConditionReconcileSuccess,
+			metav1.ConditionFalse, "TargetConnFailed", err.Error(), f.backup.Generation)
+		return fmt.Errorf("resolving target connection: %s", err)
+	}
+
+	if err := restore.Apply(configPath, plan, restoreDataDir, target); err != nil {
+		api.SetBackupCondition(&f.backup.Status, api.BackupConditionReconcileSuccess,
+			metav1.ConditionFalse, "ApplyFailed", err.Error(), f.backup.Generation)
+		return fmt.Errorf("applying restore plan: %s", err)
+	}
+
+	f.backup.MarkRestored(plan.StopGTID, metav1.Now())
+	api.SetBackupCondition(&f.backup.Status, api.BackupConditionReconcileSuccess,
+		metav1.ConditionTrue, "Restored", "", f.backup.Generation)
+	return nil
+}
+
+// targetConn reads the cluster's root credentials and resolves the restore
+// target host. That host must be a fresh instance provisioned for the
+// restore (see RestoreTarget.Host), never the cluster's live master: binlog
+// replay reapplies historical statements, which would corrupt an
+// already-running master that has executed them.
+func (f *bFactory) targetConn(ctx context.Context) (restore.TargetConn, error) {
+	if len(f.backup.Spec.RestoreTarget.Host) == 0 {
+		return restore.TargetConn{}, fmt.Errorf("restoreTarget.host is unset")
+	}
+
+	secret, err := f.client.CoreV1().Secrets(f.namespace).Get(ctx, f.cluster.Spec.SecretName, metav1.GetOptions{})
+	if err != nil {
+		return restore.TargetConn{}, fmt.Errorf("reading cluster secret: %s", err)
+	}
+
+	rootPassword, err := f.cluster.GetRootPassword(secret)
+	if err != nil {
+		return restore.TargetConn{}, err
+	}
+
+	return restore.TargetConn{
+		Host:     f.backup.Spec.RestoreTarget.Host,
+		User:     "root",
+		Password: rootPassword,
+	}, nil
+}
+
+// rcloneConfig reads storage's credentials and renders them to a temporary
+// rclone config file for restore.Resolve/Apply to shell out to. The caller
+// must call the returned cleanup func.
+func (f *bFactory) rcloneConfig(ctx context.Context, storage *api.BackupStorage) (path string, cleanup func(), err error) {
+	secret, err := f.client.CoreV1().Secrets(f.namespace).Get(ctx, storage.SecretRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", nil, fmt.Errorf("reading backup storage secret: %s", err)
+	}
+
+	contents, err := apptakebackup.BuildRcloneConfig(storage, secret.Data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "rclone-*.conf")
+	if err != nil {
+		return "", nil, err
+	}
+	defer tmp.Close()
+
+	if _, err := tmp.WriteString(contents); err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+}
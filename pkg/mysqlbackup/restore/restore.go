@@ -0,0 +1,212 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package restore resolves a MysqlBackup.Spec.RestoreTarget to a full
+// backup plus the binlog segments needed to replay up to that point, and
+// drives xtrabackup/mysqlbinlog to apply them.
+package restore
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	api "github.com/presslabs/mysql-operator/pkg/apis/mysql/v1alpha1"
+	"github.com/presslabs/mysql-operator/pkg/util/rclone"
+)
+
+// Plan describes the sequence of steps needed to satisfy a RestoreTarget:
+// which full backup to prepare, and which binlog segments to replay
+// afterwards, in order.
+type Plan struct {
+	FullBackupPath string
+	BinlogSegments []string
+	StopDatetime   string
+	StopGTID       string
+}
+
+// Resolve picks the newest full backup at or before target and, for
+// Timestamp/GTID targets, the binlog segments needed to replay up to it.
+func Resolve(configPath string, storage *api.BackupStorage, clusterName string, target api.RestoreTarget) (*Plan, error) {
+	remote, err := storage.RemotePath(clusterName)
+	if err != nil {
+		return nil, fmt.Errorf("restore: resolving remote path: %s", err)
+	}
+
+	full, err := newestFullBackupBefore(configPath, remote, target)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{FullBackupPath: full}
+	if target.Kind == api.RestoreTargetLatestFull || target.Kind == "" {
+		return plan, nil
+	}
+
+	binlogDir, err := api.BinlogPrefix(storage, clusterName)
+	if err != nil {
+		return nil, fmt.Errorf("restore: resolving binlog prefix: %s", err)
+	}
+
+	segments, err := rclone.List(configPath, binlogDir)
+	if err != nil {
+		return nil, fmt.Errorf("restore: listing binlog segments: %s", err)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].ModTime.Before(segments[j].ModTime) })
+	for _, s := range segments {
+		plan.BinlogSegments = append(plan.BinlogSegments, binlogDir+"/"+s.Path)
+	}
+
+	switch target.Kind {
+	case api.RestoreTargetTimestamp:
+		if target.Timestamp == nil {
+			return nil, fmt.Errorf("restore: target kind is Timestamp but Timestamp is nil")
+		}
+		plan.StopDatetime = target.Timestamp.UTC().Format("2006-01-02 15:04:05")
+	case api.RestoreTargetGTID:
+		if len(target.GTID) == 0 {
+			return nil, fmt.Errorf("restore: target kind is GTID but GTID is empty")
+		}
+		plan.StopGTID = target.GTID
+	}
+
+	return plan, nil
+}
+
+// TargetConn carries the connection details Apply needs to replay binlogs
+// into the restored server. Password is passed via the MYSQL_PWD
+// environment variable rather than a CLI flag, the same convention the
+// rest of the operator uses for the mysql client.
+type TargetConn struct {
+	Host     string
+	User     string
+	Password string
+	Database string
+}
+
+// Apply runs the plan: fetches plan.FullBackupPath into dataDir, runs
+// xtrabackup --prepare on it, then replays each binlog segment in order up
+// to the configured stop point against target.
+func Apply(configPath string, plan *Plan, dataDir string, target TargetConn) error {
+	if err := fetchFullBackup(configPath, plan.FullBackupPath, dataDir); err != nil {
+		return err
+	}
+
+	prepareArgs := []string{"--prepare", "--target-dir", dataDir}
+	if err := exec.Command("xtrabackup", prepareArgs...).Run(); err != nil {
+		return fmt.Errorf("restore: xtrabackup --prepare failed: %s", err)
+	}
+
+	for _, segment := range plan.BinlogSegments {
+		args := []string{segment}
+		if len(plan.StopDatetime) != 0 {
+			args = append(args, "--stop-datetime", plan.StopDatetime)
+		}
+		if len(plan.StopGTID) != 0 {
+			// mysqlbinlog has no GTID-based stop flag: --stop-position takes
+			// a numeric log position, not a GTID set. --include-gtids
+			// restricts replay to exactly the transactions in the set,
+			// which is the equivalent "stop after this GTID" behaviour.
+			args = append(args, "--include-gtids", plan.StopGTID)
+		}
+		replay := exec.Command("mysqlbinlog", args...)
+
+		applyArgs := []string{"--host", target.Host}
+		if len(target.User) != 0 {
+			applyArgs = append(applyArgs, "--user", target.User)
+		}
+		if len(target.Database) != 0 {
+			applyArgs = append(applyArgs, target.Database)
+		}
+		apply := exec.Command("mysql", applyArgs...)
+		if len(target.Password) != 0 {
+			apply.Env = append(os.Environ(), "MYSQL_PWD="+target.Password)
+		}
+		apply.Stdin, _ = replay.StdoutPipe()
+
+		if err := apply.Start(); err != nil {
+			return fmt.Errorf("restore: starting mysql client for %s: %s", segment, err)
+		}
+		if err := replay.Run(); err != nil {
+			return fmt.Errorf("restore: replaying %s: %s", segment, err)
+		}
+		if err := apply.Wait(); err != nil {
+			return fmt.Errorf("restore: applying %s: %s", segment, err)
+		}
+	}
+
+	return nil
+}
+
+// fetchFullBackup downloads remotePath (a gzipped xbstream, the same format
+// apptakebackup.StreamBackupCmd produces) and unpacks it into dataDir for
+// xtrabackup --prepare to operate on.
+func fetchFullBackup(configPath, remotePath, dataDir string) error {
+	if err := rclone.Copy(configPath, remotePath, dataDir); err != nil {
+		return fmt.Errorf("restore: downloading %s: %s", remotePath, err)
+	}
+
+	local := filepath.Join(dataDir, filepath.Base(remotePath))
+	defer os.Remove(local)
+
+	f, err := os.Open(local)
+	if err != nil {
+		return fmt.Errorf("restore: opening downloaded backup %s: %s", local, err)
+	}
+	defer f.Close()
+
+	gunzip := exec.Command("gunzip", "-c")
+	gunzip.Stdin = f
+	xbstream := exec.Command("xbstream", "-x", "-C", dataDir)
+	xbstream.Stdin, _ = gunzip.StdoutPipe()
+
+	if err := xbstream.Start(); err != nil {
+		return fmt.Errorf("restore: starting xbstream: %s", err)
+	}
+	if err := gunzip.Run(); err != nil {
+		return fmt.Errorf("restore: gunzip %s failed: %s", local, err)
+	}
+	if err := xbstream.Wait(); err != nil {
+		return fmt.Errorf("restore: xbstream extract failed: %s", err)
+	}
+	return nil
+}
+
+func newestFullBackupBefore(configPath, remote string, target api.RestoreTarget) (string, error) {
+	objects, err := rclone.List(configPath, remote)
+	if err != nil {
+		return "", fmt.Errorf("listing %s: %s", remote, err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].ModTime.After(objects[j].ModTime) })
+
+	for _, obj := range objects {
+		// The listing also holds the binlog/ directory and any other
+		// object; only files named like GetBackupURL's are full backups.
+		if !strings.HasSuffix(obj.Path, ".xbstream.gz") {
+			continue
+		}
+		if target.Kind == api.RestoreTargetTimestamp && target.Timestamp != nil && obj.ModTime.After(target.Timestamp.Time) {
+			continue
+		}
+		return remote + "/" + obj.Path, nil
+	}
+
+	return "", fmt.Errorf("no full backup found at or before target")
+}
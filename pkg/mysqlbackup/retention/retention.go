@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package retention prunes expired backups from a cluster's BackupStorage,
+// enforcing the count/age policy configured on MysqlCluster.Spec.BackupStorage.Retention.
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	api "github.com/presslabs/mysql-operator/pkg/apis/mysql/v1alpha1"
+	"github.com/presslabs/mysql-operator/pkg/util/rclone"
+)
+
+// Prune lists the objects under the cluster's backup remote and removes
+// the ones that fall outside policy: everything past the newest Count
+// objects, and anything older than MaxAge. Objects are walked (and removed)
+// newest first. It returns the paths it removed.
+//
+// The binlog/ prefix under the same remote (see api.BinlogPrefix) holds PITR
+// segments on a separate retention schedule of their own and is skipped here
+// entirely, so a backup count/age policy can never reach in and delete it.
+func Prune(configPath string, storage *api.BackupStorage, clusterName string, policy api.BackupRetentionPolicy) ([]string, error) {
+	remote, err := storage.RemotePath(clusterName)
+	if err != nil {
+		return nil, fmt.Errorf("retention: resolving remote path: %s", err)
+	}
+
+	binlogDir, err := api.BinlogPrefix(storage, clusterName)
+	if err != nil {
+		return nil, fmt.Errorf("retention: resolving binlog prefix: %s", err)
+	}
+	binlogEntry := strings.TrimPrefix(binlogDir, remote+"/")
+
+	objects, err := rclone.List(configPath, remote)
+	if err != nil {
+		return nil, fmt.Errorf("retention: listing %s: %s", remote, err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].ModTime.After(objects[j].ModTime)
+	})
+
+	var maxAge time.Duration
+	if len(policy.MaxAge) != 0 {
+		if maxAge, err = time.ParseDuration(policy.MaxAge); err != nil {
+			return nil, fmt.Errorf("retention: invalid maxAge %q: %s", policy.MaxAge, err)
+		}
+	}
+
+	var removed []string
+	count := 0
+	for _, obj := range objects {
+		if obj.Path == binlogEntry || strings.HasPrefix(obj.Path, binlogEntry+"/") {
+			continue
+		}
+
+		expiredByCount := policy.Count > 0 && count >= policy.Count
+		expiredByAge := maxAge > 0 && time.Since(obj.ModTime) > maxAge
+		count++
+		if !expiredByCount && !expiredByAge {
+			continue
+		}
+
+		path := fmt.Sprintf("%s/%s", remote, obj.Path)
+		if err := rclone.Remove(configPath, path); err != nil {
+			glog.Warningf("[retention] failed removing %s: %s", path, err)
+			continue
+		}
+		removed = append(removed, path)
+	}
+
+	return removed, nil
+}
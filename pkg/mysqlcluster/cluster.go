@@ -19,16 +19,26 @@ package mysqlcluster
 import (
 	"context"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/golang/glog"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/record"
 
 	api "github.com/presslabs/mysql-operator/pkg/apis/mysql/v1alpha1"
+	"github.com/presslabs/mysql-operator/pkg/apptakebackup"
 	ticlientset "github.com/presslabs/mysql-operator/pkg/generated/clientset/versioned"
+	"github.com/presslabs/mysql-operator/pkg/mysqlbackup/retention"
+	"github.com/presslabs/mysql-operator/pkg/mysqlcluster/manager"
+	"github.com/presslabs/mysql-operator/pkg/mysqldatascript"
 	"github.com/presslabs/mysql-operator/pkg/util/options"
 	orc "github.com/presslabs/mysql-operator/pkg/util/orchestrator"
+	"github.com/presslabs/mysql-operator/pkg/util/rclone"
 )
 
 // Interface is for cluster Factory
@@ -47,14 +57,18 @@ type cFactory struct {
 	client   kubernetes.Interface
 	myClient ticlientset.Interface
 	rec      record.EventRecorder
+	mgr      *manager.ClusterManager
 
 	configHash string
 	secretHash string
 }
 
-// New creates a new cluster factory
+// New creates a new cluster factory. mgr is the shared ClusterManager
+// (constructed once by the controller, not per-reconcile) whose
+// long-lived per-cluster goroutine is started/refreshed from Sync and
+// stopped once the cluster is deleted.
 func New(cluster *api.MysqlCluster, opt *options.Options, klient kubernetes.Interface,
-	myClient ticlientset.Interface, ns string, rec record.EventRecorder) Interface {
+	myClient ticlientset.Interface, ns string, rec record.EventRecorder, mgr *manager.ClusterManager) Interface {
 	return &cFactory{
 		cluster:    cluster,
 		opt:        opt,
@@ -62,6 +76,7 @@ func New(cluster *api.MysqlCluster, opt *options.Options, klient kubernetes.Inte
 		myClient:   myClient,
 		namespace:  ns,
 		rec:        rec,
+		mgr:        mgr,
 		configHash: "1",
 		secretHash: "1",
 	}
@@ -128,12 +143,22 @@ func (f *cFactory) getComponents() []component {
 }
 
 func (f *cFactory) Sync(ctx context.Context) error {
+	name := types.NamespacedName{Name: f.cluster.Name, Namespace: f.cluster.Namespace}
+	if f.mgr != nil {
+		if f.cluster.DeletionTimestamp != nil {
+			f.mgr.Stop(name)
+		} else {
+			f.mgr.Update(ctx, name)
+		}
+	}
+
 	for _, comp := range f.getComponents() {
 		state, err := comp.syncFn()
 		if err != nil {
 			glog.Warningf("[%s]: failed syncing %s: ", comp.alias, comp.name, err.Error())
 			err = fmt.Errorf("%s sync failed: %s", comp.name, err)
 			f.rec.Event(f.cluster, api.EventWarning, comp.reasonFailed, err.Error())
+			f.updateConditions(ctx, err)
 			return err
 		} else {
 			glog.V(2).Infof("[%s]: %s ... (%s)", comp.alias, comp.name, state)
@@ -144,6 +169,20 @@ func (f *cFactory) Sync(ctx context.Context) error {
 		}
 	}
 
+	if err := f.syncCredentials(ctx); err != nil {
+		glog.Warningf("[cluster-secret]: failed syncing credentials: %s", err.Error())
+		err = fmt.Errorf("credentials sync failed: %s", err)
+		f.rec.Event(f.cluster, api.EventWarning, api.EventReasonDbSecretFailed, err.Error())
+		f.updateConditions(ctx, err)
+		return err
+	}
+
+	if err := f.syncBackupRetention(ctx); err != nil {
+		// pruning is a best-effort side effect of reconciling, not
+		// something that should block the rest of Sync.
+		glog.Warningf("[backup-retention]: %s", err.Error())
+	}
+
 	// Register nodes in orchestrator
 	if len(f.cluster.Spec.GetOrcUri()) != 0 {
 		// try to discover ready nodes into orchestrator
@@ -155,9 +194,158 @@ func (f *cFactory) Sync(ctx context.Context) error {
 			}
 		}
 	}
+
+	f.updateConditions(ctx, nil)
 	return nil
 }
 
+// updateConditions computes the per-component condition contributions and
+// merges them into the cluster status. It's called at the end of every
+// Sync, whether or not the sync itself succeeded, so that Available and
+// Healthy always reflect the latest orchestrator view even when a
+// component sync failed.
+func (f *cFactory) updateConditions(ctx context.Context, syncErr error) {
+	status := &f.cluster.Status
+	generation := f.cluster.Generation
+
+	if syncErr != nil {
+		api.SetClusterCondition(status, api.ClusterConditionReconcileSuccess,
+			metav1.ConditionFalse, "SyncFailed", syncErr.Error(), generation)
+	} else {
+		api.SetClusterCondition(status, api.ClusterConditionReconcileSuccess,
+			metav1.ConditionTrue, "SyncOK", "", generation)
+	}
+
+	available := metav1.ConditionFalse
+	availableReason, availableMessage := "NoReadyNodes", "no ready nodes yet"
+	healthy := metav1.ConditionFalse
+	healthyReason, healthyMessage := "NoReadyNodes", "no ready nodes yet"
+
+	// Available requires a majority of the *configured* replicas to be
+	// ready, not a majority of the fixed number of k8s-object sync steps.
+	majority := f.cluster.Spec.GetReplicas()/2 + 1
+
+	if len(f.cluster.Spec.GetOrcUri()) != 0 {
+		client := orc.NewFromUri(f.cluster.Spec.GetOrcUri())
+		orcClusterName := fmt.Sprintf("%s.%s", f.cluster.Name, f.cluster.Namespace)
+
+		if _, err := client.Master(orcClusterName); err == nil && status.ReadyNodes >= majority {
+			available = metav1.ConditionTrue
+			availableReason, availableMessage = "MasterElected", "a majority of pods are reachable and a master is elected"
+		} else if err != nil {
+			availableReason, availableMessage = "NoMaster", err.Error()
+		} else {
+			availableReason, availableMessage = "BelowMajority", fmt.Sprintf("%d/%d ready, need %d", status.ReadyNodes, f.cluster.Spec.GetReplicas(), majority)
+		}
+
+		maxLag := f.cluster.Spec.GetMaxSecondsBehindMaster()
+		if replicas, err := client.ClusterOSCReplicas(f.cluster.Name); err == nil {
+			allInSync := true
+			for _, r := range replicas {
+				if !r.SecondsBehindMaster.Valid || r.SecondsBehindMaster.Int64 > maxLag {
+					allInSync = false
+					break
+				}
+			}
+			if allInSync {
+				healthy = metav1.ConditionTrue
+				healthyReason, healthyMessage = "LagUnderThreshold", "all replicas are within the configured lag threshold"
+			} else {
+				healthyReason, healthyMessage = "LagAboveThreshold", "at least one replica exceeds the configured lag threshold"
+			}
+		} else {
+			healthyReason, healthyMessage = "OrcUnreachable", err.Error()
+		}
+	} else if status.ReadyNodes >= majority {
+		// without orchestrator we can only infer from the ready node count
+		available, healthy = metav1.ConditionTrue, metav1.ConditionTrue
+		availableReason, availableMessage = "ReadyNodes", "orchestrator not configured, falling back to ready node count"
+		healthyReason, healthyMessage = availableReason, availableMessage
+	}
+
+	api.SetClusterCondition(status, api.ClusterConditionAvailable, available, availableReason, availableMessage, generation)
+	api.SetClusterCondition(status, api.ClusterConditionHealthy, healthy, healthyReason, healthyMessage, generation)
+
+	f.updateStatefulSetReadyCondition(ctx, generation)
+	f.updatePITRWindowCondition(ctx, status, generation)
+}
+
+// updatePITRWindowCondition sets the PITRWindow condition from the oldest
+// binlog segment currently retained for the cluster, or sets it False when
+// binlog shipping isn't enabled.
+func (f *cFactory) updatePITRWindowCondition(ctx context.Context, status *api.MysqlClusterStatus, generation int64) {
+	if !f.cluster.Spec.BinlogShipper.Enabled {
+		api.UpdatePITRWindowCondition(status, nil, generation)
+		return
+	}
+
+	binlogDir, err := api.BinlogPrefix(&f.cluster.Spec.BackupStorage, f.cluster.Name)
+	if err != nil {
+		glog.Warningf("[pitr-window]: resolving binlog prefix: %s", err.Error())
+		return
+	}
+
+	configPath, cleanup, err := f.backupStorageRcloneConfig(ctx)
+	if err != nil {
+		glog.Warningf("[pitr-window]: building rclone config: %s", err.Error())
+		return
+	}
+	defer cleanup()
+
+	segments, err := rclone.List(configPath, binlogDir)
+	if err != nil {
+		glog.Warningf("[pitr-window]: listing retained binlog segments: %s", err.Error())
+		return
+	}
+	if len(segments) == 0 {
+		api.UpdatePITRWindowCondition(status, nil, generation)
+		return
+	}
+
+	oldest := segments[0].ModTime
+	for _, s := range segments[1:] {
+		if s.ModTime.Before(oldest) {
+			oldest = s.ModTime
+		}
+	}
+	oldestTime := metav1.NewTime(oldest)
+	api.UpdatePITRWindowCondition(status, &oldestTime, generation)
+}
+
+// updateStatefulSetReadyCondition reads the actual StatefulSet object and
+// reports whether its spec generation matches status.observedGeneration and
+// the rolling update has finished, as the request asks for, instead of
+// inferring readiness from the sync loop's returned status string.
+func (f *cFactory) updateStatefulSetReadyCondition(ctx context.Context, generation int64) {
+	status := &f.cluster.Status
+	name := f.cluster.GetNameForResource(api.StatefulSet)
+
+	sfs, err := f.client.AppsV1().StatefulSets(f.namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		api.SetClusterCondition(status, api.ClusterConditionStatefulSetReady, metav1.ConditionFalse,
+			"NotFound", "statefulset does not exist yet", generation)
+		return
+	}
+	if err != nil {
+		api.SetClusterCondition(status, api.ClusterConditionStatefulSetReady, metav1.ConditionFalse,
+			"GetFailed", err.Error(), generation)
+		return
+	}
+
+	generationMatches := sfs.Status.ObservedGeneration == sfs.Generation
+	rolloutComplete := sfs.Status.CurrentRevision == sfs.Status.UpdateRevision &&
+		sfs.Spec.Replicas != nil && sfs.Status.UpdatedReplicas == *sfs.Spec.Replicas
+
+	if generationMatches && rolloutComplete {
+		api.SetClusterCondition(status, api.ClusterConditionStatefulSetReady, metav1.ConditionTrue,
+			"RollingUpdateDone", "spec generation matches observedGeneration and the rolling update is complete", generation)
+		return
+	}
+
+	api.SetClusterCondition(status, api.ClusterConditionStatefulSetReady, metav1.ConditionFalse,
+		"Reconciling", "waiting for the statefulset rolling update to finish", generation)
+}
+
 func (f *cFactory) getOwnerReferences(ors ...[]metav1.OwnerReference) []metav1.OwnerReference {
 	rs := []metav1.OwnerReference{
 		f.cluster.AsOwnerReference(),
@@ -175,3 +363,135 @@ func (f *cFactory) getHostForReplica(no int) string {
 		f.cluster.GetNameForResource(api.HeadlessSVC),
 		f.cluster.Namespace)
 }
+
+// syncCredentials fills in any secret keys the operator generates on the
+// user's behalf, then, if RotateCredentialsAnnotation is set, rotates the
+// non-root credentials and applies them in MySQL before removing the
+// annotation.
+func (f *cFactory) syncCredentials(ctx context.Context) error {
+	secret, err := f.client.CoreV1().Secrets(f.namespace).Get(ctx, f.cluster.Spec.SecretName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("reading cluster secret: %s", err)
+	}
+
+	generated, err := api.EnsureSecretKeys(secret)
+	if err != nil {
+		return fmt.Errorf("generating secret keys: %s", err)
+	}
+
+	_, rotationRequested := f.cluster.Annotations[api.RotateCredentialsAnnotation]
+	if rotationRequested {
+		if _, err := api.RotateKeys(secret); err != nil {
+			return fmt.Errorf("rotating secret keys: %s", err)
+		}
+	}
+
+	if len(generated) != 0 || rotationRequested {
+		if _, err := f.client.CoreV1().Secrets(f.namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("updating cluster secret: %s", err)
+		}
+	}
+	if len(generated) != 0 {
+		f.cluster.Status.Credentials.GeneratedKeys = generated
+	}
+
+	if !rotationRequested {
+		return nil
+	}
+
+	if err := f.rotateCredentials(ctx, secret); err != nil {
+		return fmt.Errorf("applying rotated credentials: %s", err)
+	}
+
+	delete(f.cluster.Annotations, api.RotateCredentialsAnnotation)
+	now := metav1.Now()
+	f.cluster.Status.Credentials.LastRotatedAt = &now
+	return nil
+}
+
+// rotateCredentials applies secret's current passwords in MySQL by running
+// the resulting ALTER USER statements against the master, reusing the same
+// MysqlDataScript job mechanism used for any other one-shot SQL.
+func (f *cFactory) rotateCredentials(ctx context.Context, secret *core.Secret) error {
+	statements := api.AlterUserStatements(secret)
+	if len(statements) == 0 {
+		return nil
+	}
+
+	script := &api.MysqlDataScript{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf("%s-rotate-credentials", f.cluster.Name),
+			Namespace:       f.namespace,
+			OwnerReferences: []metav1.OwnerReference{f.cluster.AsOwnerReference()},
+		},
+		Spec: api.MysqlDataScriptSpec{
+			ClusterName:      f.cluster.Name,
+			Script:           strings.Join(statements, ";\n"),
+			Target:           api.TargetMaster,
+			AllowDestructive: false,
+		},
+	}
+
+	df := mysqldatascript.New(script, f.cluster, f.client, f.myClient, f.namespace, f.mgr)
+	return df.Sync(ctx)
+}
+
+// syncBackupRetention prunes expired backups according to the cluster's
+// BackupStorage.Retention policy. Pruning is a lightweight, best-effort
+// side effect of reconciling rather than something that needs its own Job.
+func (f *cFactory) syncBackupRetention(ctx context.Context) error {
+	storage := &f.cluster.Spec.BackupStorage
+	policy := storage.Retention
+	if policy.Count == 0 && len(policy.MaxAge) == 0 {
+		return nil
+	}
+
+	configPath, cleanup, err := f.backupStorageRcloneConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("building rclone config: %s", err)
+	}
+	defer cleanup()
+
+	removed, err := retention.Prune(configPath, storage, f.cluster.Name, policy)
+	if err != nil {
+		return fmt.Errorf("pruning backups: %s", err)
+	}
+	if len(removed) != 0 {
+		glog.V(2).Infof("[backup-retention] pruned %d expired backup(s) for %s", len(removed), f.cluster.Name)
+	}
+	return nil
+}
+
+// backupStorageRcloneConfig reads the cluster's BackupStorage credentials
+// and renders them to a temporary rclone config file, for the retention
+// and PITR-window code paths that shell out to rclone directly from the
+// controller process. The caller must call the returned cleanup func.
+func (f *cFactory) backupStorageRcloneConfig(ctx context.Context) (path string, cleanup func(), err error) {
+	storage := &f.cluster.Spec.BackupStorage
+	if storage.SecretRef == nil {
+		return "", nil, fmt.Errorf("backupStorage.secretRef is unset")
+	}
+
+	secret, err := f.client.CoreV1().Secrets(f.namespace).Get(ctx, storage.SecretRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", nil, fmt.Errorf("reading backup storage secret: %s", err)
+	}
+
+	contents, err := apptakebackup.BuildRcloneConfig(storage, secret.Data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "rclone-*.conf")
+	if err != nil {
+		return "", nil, err
+	}
+	defer tmp.Close()
+
+	if _, err := tmp.WriteString(contents); err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+}
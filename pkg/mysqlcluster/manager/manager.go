@@ -0,0 +1,436 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package manager runs one long-lived goroutine per MysqlCluster that
+// continuously polls MySQL for cluster health, independently of the
+// informer's reconcile ticks. It mirrors the design cybozu-go/moco uses to
+// separate "shape the k8s objects" (cFactory.Sync) from "watch the running
+// cluster" (the managerProcess owned here). A ClusterManager is meant to be
+// constructed once and shared by every cFactory/dFactory: its value comes
+// from the goroutines outliving any single reconcile, so callers must
+// inject an existing instance rather than build one per Sync.
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	api "github.com/presslabs/mysql-operator/pkg/apis/mysql/v1alpha1"
+	"github.com/presslabs/mysql-operator/pkg/util/dbop"
+	orc "github.com/presslabs/mysql-operator/pkg/util/orchestrator"
+)
+
+// defaultPollInterval is used until the first successful poll reads
+// ClusterSpec.GetPollIntervalSeconds. A later getCluster failure keeps the
+// interval the last successful poll read.
+const defaultPollInterval = 10 * time.Second
+
+// defaultMysqlPort is the MySQL port every pod listens on. It's redeclared
+// here, rather than imported from pkg/mysqlcluster, to avoid that package
+// importing this one back (it calls Update/Stop on a ClusterManager).
+const defaultMysqlPort = 3306
+
+// consecutiveFailuresBeforeRediscover is how many consecutive polls must
+// fail to find an elected master before the manager re-registers every
+// ready pod with orchestrator, giving its own recovery logic a fresh
+// topology to promote from.
+const consecutiveFailuresBeforeRediscover = 3
+
+var (
+	clusterHasMaster = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mysql_operator",
+		Name:      "cluster_has_master",
+		Help:      "1 if orchestrator has an elected master for the cluster as of the last poll, 0 otherwise.",
+	}, []string{"cluster", "namespace"})
+
+	secondsBehindMaster = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mysql_operator",
+		Name:      "seconds_behind_master",
+		Help:      "Replication lag reported by the most recent manager poll, per replica host.",
+	}, []string{"cluster", "namespace", "host"})
+)
+
+// orcClient is the subset of the orchestrator client the manager needs. It's
+// declared locally so managerProcess can cache one across polls instead of
+// dialing a fresh client every tick, without needing the concrete type
+// orc.NewFromUri returns.
+type orcClient interface {
+	Master(clusterName string) (orc.Instance, error)
+	ClusterOSCReplicas(clusterName string) ([]orc.Instance, error)
+	Discover(host string, port int) error
+}
+
+// ClusterGetter returns the current view of a cluster so a managerProcess
+// can read its spec (orchestrator URI, poll interval) without holding a
+// copy that goes stale across reconciles.
+type ClusterGetter func(name types.NamespacedName) (*api.MysqlCluster, error)
+
+// StatusUpdater persists status changes (conditions) a managerProcess makes
+// between reconciles. Callers wire this to the generated clientset's
+// UpdateStatus, the same call cFactory.Sync's caller uses.
+type StatusUpdater func(ctx context.Context, cluster *api.MysqlCluster) error
+
+// ClusterManager owns one managerProcess per MysqlCluster. The existing
+// cFactory.Sync remains responsible for k8s object shape; the manager owns
+// runtime cluster health: watching SecondsBehindMaster, driving failover
+// decisions and updating conditions between reconciles.
+type ClusterManager struct {
+	getCluster   ClusterGetter
+	client       kubernetes.Interface
+	updateStatus StatusUpdater
+
+	mu        sync.Mutex
+	processes map[types.NamespacedName]*managerProcess
+}
+
+// New creates a ClusterManager. getCluster is called by every managerProcess
+// on each poll to read the latest cluster spec; client is used to read
+// replication credentials for the dbop connection pool; updateStatus
+// persists conditions the manager sets between reconciles.
+func New(getCluster ClusterGetter, client kubernetes.Interface, updateStatus StatusUpdater) *ClusterManager {
+	return &ClusterManager{
+		getCluster:   getCluster,
+		client:       client,
+		updateStatus: updateStatus,
+		processes:    make(map[types.NamespacedName]*managerProcess),
+	}
+}
+
+// Update starts a managerProcess for name if one isn't already running, or
+// nudges the existing one to poll (and re-read the cluster spec) right away,
+// without waiting for its next tick.
+// Call it from the reconciler every time a MysqlCluster is seen.
+func (m *ClusterManager) Update(ctx context.Context, name types.NamespacedName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p, ok := m.processes[name]; ok {
+		select {
+		case p.refresh <- struct{}{}:
+		default:
+		}
+		return
+	}
+
+	p := newManagerProcess(name, m.getCluster, m.client, m.updateStatus)
+	m.processes[name] = p
+	go p.run(ctx)
+}
+
+// Stop terminates the managerProcess for name and closes its DB
+// connections. It's a no-op if no process is running for name. Call it
+// when the MysqlCluster is deleted.
+func (m *ClusterManager) Stop(name types.NamespacedName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p, ok := m.processes[name]; ok {
+		p.cancel()
+		delete(m.processes, name)
+	}
+}
+
+// Master returns the master hostname the manager last observed for name,
+// and whether it's observed one at all yet. Callers (e.g.
+// mysqldatascript's resolveHosts) should fall back to the cluster's
+// synchronous GetMasterHost when ok is false, such as right after startup
+// before the first poll has run.
+func (m *ClusterManager) Master(name types.NamespacedName) (host string, ok bool) {
+	m.mu.Lock()
+	p, exists := m.processes[name]
+	m.mu.Unlock()
+	if !exists {
+		return "", false
+	}
+	return p.cachedMaster()
+}
+
+// HealthyReplica returns a replica hostname within the configured lag
+// threshold the manager last observed for name, and whether it's observed
+// one at all yet.
+func (m *ClusterManager) HealthyReplica(name types.NamespacedName) (host string, ok bool) {
+	m.mu.Lock()
+	p, exists := m.processes[name]
+	m.mu.Unlock()
+	if !exists {
+		return "", false
+	}
+	return p.cachedHealthyReplica()
+}
+
+// managerProcess polls a single cluster's runtime health on its own
+// interval, independent of the controller's reconcile loop.
+type managerProcess struct {
+	name         types.NamespacedName
+	getCluster   ClusterGetter
+	client       kubernetes.Interface
+	updateStatus StatusUpdater
+
+	refresh chan struct{}
+	cancel  context.CancelFunc
+
+	// orc is cached across polls instead of being redialed every tick.
+	orc orcClient
+	// dbPool holds the direct MySQL connections used to double-check
+	// replication lag independently of orchestrator, and is closed by Stop.
+	dbPool *dbop.Pool
+
+	stateMu             sync.RWMutex
+	master              string
+	healthyReplica      string
+	consecutiveNoMaster int
+	dsnCache            map[string]string
+	pollInterval        time.Duration
+}
+
+func newManagerProcess(name types.NamespacedName, getCluster ClusterGetter,
+	client kubernetes.Interface, updateStatus StatusUpdater) *managerProcess {
+	return &managerProcess{
+		name:         name,
+		getCluster:   getCluster,
+		client:       client,
+		updateStatus: updateStatus,
+		refresh:      make(chan struct{}, 1),
+		dbPool:       dbop.NewPool(),
+		dsnCache:     make(map[string]string),
+	}
+}
+
+func (p *managerProcess) run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	p.cancel = cancel
+	defer p.dbPool.CloseAll()
+
+	glog.V(2).Infof("[cluster-manager] starting manager process for %s", p.name)
+	defer glog.V(2).Infof("[cluster-manager] stopped manager process for %s", p.name)
+
+	interval := defaultPollInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.refresh:
+			p.poll(ctx)
+		case <-ticker.C:
+			p.poll(ctx)
+		}
+
+		// poll just read (or failed to read) the cluster's tunable
+		// interval; pick up the change so a retuned cluster doesn't have
+		// to wait for a process restart.
+		if next := p.cachedPollInterval(); next != interval {
+			ticker.Reset(next)
+			interval = next
+		}
+	}
+}
+
+// poll watches SecondsBehindMaster, drives failover decisions and updates
+// conditions between reconciles. It's tolerant of transient orchestrator
+// errors since, unlike a reconcile, it runs continuously.
+func (p *managerProcess) poll(ctx context.Context) {
+	cluster, err := p.getCluster(p.name)
+	if err != nil {
+		glog.Warningf("[cluster-manager] %s: failed to get cluster: %s", p.name, err)
+		return
+	}
+
+	p.stateMu.Lock()
+	p.pollInterval = time.Duration(cluster.Spec.GetPollIntervalSeconds()) * time.Second
+	p.stateMu.Unlock()
+
+	orcURI := cluster.Spec.GetOrcUri()
+	if len(orcURI) == 0 {
+		return
+	}
+	if p.orc == nil {
+		p.orc = orc.NewFromUri(orcURI)
+	}
+
+	orcClusterName := cluster.Name + "." + cluster.Namespace
+	generation := cluster.Generation
+	status := &cluster.Status
+
+	var haveMaster bool
+	if master, err := p.orc.Master(orcClusterName); err != nil {
+		glog.Warningf("[cluster-manager] %s: no master elected: %s", p.name, err)
+		clusterHasMaster.WithLabelValues(cluster.Name, cluster.Namespace).Set(0)
+
+		p.stateMu.Lock()
+		p.master = ""
+		p.consecutiveNoMaster++
+		noMaster := p.consecutiveNoMaster
+		p.stateMu.Unlock()
+
+		if noMaster >= consecutiveFailuresBeforeRediscover {
+			p.driveRecovery(cluster, noMaster)
+		}
+	} else {
+		haveMaster = true
+		clusterHasMaster.WithLabelValues(cluster.Name, cluster.Namespace).Set(1)
+		p.stateMu.Lock()
+		p.master = master.Key.Hostname
+		p.consecutiveNoMaster = 0
+		p.stateMu.Unlock()
+	}
+
+	// Available is also derived here, not just in cFactory.Sync, so
+	// `kubectl wait --for=condition=Available` tracks master elections at
+	// this process's own poll interval instead of only the reconcile tick.
+	majority := cluster.Spec.GetReplicas()/2 + 1
+	switch {
+	case haveMaster && status.ReadyNodes >= majority:
+		api.SetClusterCondition(status, api.ClusterConditionAvailable, metav1.ConditionTrue,
+			"MasterElected", "a majority of pods are reachable and a master is elected", generation)
+	case !haveMaster:
+		api.SetClusterCondition(status, api.ClusterConditionAvailable, metav1.ConditionFalse,
+			"NoMaster", "no master elected", generation)
+	default:
+		api.SetClusterCondition(status, api.ClusterConditionAvailable, metav1.ConditionFalse,
+			"BelowMajority", fmt.Sprintf("%d/%d ready, need %d", status.ReadyNodes, cluster.Spec.GetReplicas(), majority), generation)
+	}
+
+	maxLag := cluster.Spec.GetMaxSecondsBehindMaster()
+	replicas, err := p.orc.ClusterOSCReplicas(cluster.Name)
+	if err != nil {
+		glog.Warningf("[cluster-manager] %s: failed reading replica lag: %s", p.name, err)
+		return
+	}
+
+	allInSync := true
+	healthyReplica := ""
+	for _, r := range replicas {
+		lag := r.SecondsBehindMaster
+		if dsn, ok := p.dsnFor(cluster, r.Key.Hostname); ok {
+			if direct, err := p.dbPool.ShowSlaveStatus(dsn); err != nil {
+				glog.V(2).Infof("[cluster-manager] %s: direct poll of %s failed: %s", p.name, r.Key.Hostname, err)
+			} else if direct.SecondsBehindMaster.Valid {
+				lag = direct.SecondsBehindMaster
+			}
+		}
+
+		if lag.Valid {
+			secondsBehindMaster.WithLabelValues(cluster.Name, cluster.Namespace, r.Key.Hostname).Set(float64(lag.Int64))
+		}
+		if !lag.Valid || lag.Int64 > maxLag {
+			allInSync = false
+			continue
+		}
+		healthyReplica = r.Key.Hostname
+	}
+
+	p.stateMu.Lock()
+	p.healthyReplica = healthyReplica
+	p.stateMu.Unlock()
+
+	if allInSync {
+		api.SetClusterCondition(status, api.ClusterConditionHealthy, metav1.ConditionTrue,
+			"LagUnderThreshold", "all replicas are within the configured lag threshold", generation)
+	} else {
+		api.SetClusterCondition(status, api.ClusterConditionHealthy, metav1.ConditionFalse,
+			"LagAboveThreshold", "at least one replica exceeds the configured lag threshold", generation)
+	}
+
+	if p.updateStatus != nil {
+		if err := p.updateStatus(ctx, cluster); err != nil {
+			glog.Warningf("[cluster-manager] %s: failed persisting status: %s", p.name, err)
+		}
+	}
+}
+
+// driveRecovery re-registers every ready pod with orchestrator after
+// repeated failures to elect a master, so orchestrator's own recovery
+// logic gets a fresh topology view to promote from.
+func (p *managerProcess) driveRecovery(cluster *api.MysqlCluster, noMasterPolls int) {
+	glog.Warningf("[cluster-manager] %s: no master elected for %d consecutive polls, re-discovering nodes",
+		p.name, noMasterPolls)
+	for i := 0; i < int(cluster.Status.ReadyNodes); i++ {
+		host := cluster.GetPodHostName(i)
+		if err := p.orc.Discover(host, defaultMysqlPort); err != nil {
+			glog.Warningf("[cluster-manager] %s: re-discovering %s failed: %s", p.name, host, err)
+		}
+	}
+}
+
+// dsnFor returns the DSN used to directly poll host for replication lag,
+// reading the cluster's replication credentials from its Secret on first
+// use and caching the result for the lifetime of the process.
+func (p *managerProcess) dsnFor(cluster *api.MysqlCluster, host string) (string, bool) {
+	if p.client == nil {
+		return "", false
+	}
+
+	p.stateMu.RLock()
+	dsn, ok := p.dsnCache[host]
+	p.stateMu.RUnlock()
+	if ok {
+		return dsn, true
+	}
+
+	secret, err := p.client.CoreV1().Secrets(cluster.Namespace).Get(context.Background(), cluster.Spec.SecretName, metav1.GetOptions{})
+	if err != nil {
+		glog.V(2).Infof("[cluster-manager] %s: reading secret for direct poll: %s", p.name, err)
+		return "", false
+	}
+
+	user, password, err := cluster.GetReplicationCreds(secret)
+	if err != nil {
+		glog.V(2).Infof("[cluster-manager] %s: missing replication credentials for direct poll: %s", p.name, err)
+		return "", false
+	}
+
+	dsn = fmt.Sprintf("%s:%s@tcp(%s:%d)/information_schema?timeout=2s", user, password, host, defaultMysqlPort)
+	p.stateMu.Lock()
+	p.dsnCache[host] = dsn
+	p.stateMu.Unlock()
+	return dsn, true
+}
+
+func (p *managerProcess) cachedMaster() (string, bool) {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+	return p.master, len(p.master) != 0
+}
+
+func (p *managerProcess) cachedHealthyReplica() (string, bool) {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+	return p.healthyReplica, len(p.healthyReplica) != 0
+}
+
+// cachedPollInterval returns the interval the most recent poll read off
+// ClusterSpec.GetPollIntervalSeconds, or defaultPollInterval before the
+// first poll has run.
+func (p *managerProcess) cachedPollInterval() time.Duration {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+	if p.pollInterval <= 0 {
+		return defaultPollInterval
+	}
+	return p.pollInterval
+}
@@ -0,0 +1,358 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mysqldatascript reconciles MysqlDataScript resources: it resolves
+// the target host through the MysqlCluster's helpers and launches a
+// short-lived Job that streams the script's SQL into that host.
+package mysqldatascript
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	api "github.com/presslabs/mysql-operator/pkg/apis/mysql/v1alpha1"
+	ticlientset "github.com/presslabs/mysql-operator/pkg/generated/clientset/versioned"
+	"github.com/presslabs/mysql-operator/pkg/mysqlcluster/manager"
+)
+
+// scriptVolumeName is the name of the volume the rendered SQL Secret is
+// mounted under in the job pod.
+const scriptVolumeName = "script"
+
+// scriptMountPath is where the rendered SQL file is mounted in the job pod.
+const scriptMountPath = "/etc/mysql-datascript"
+
+// scriptFileName is the key in the Secret (and the file name once mounted)
+// holding the resolved SQL.
+const scriptFileName = "script.sql"
+
+// Interface is for the MysqlDataScript factory.
+type Interface interface {
+	// Sync resolves the target host and launches (or reconciles) the Job
+	// that runs the script.
+	Sync(ctx context.Context) error
+}
+
+// dFactory is the MysqlDataScript factory, named to mirror cFactory in
+// pkg/mysqlcluster.
+type dFactory struct {
+	script  *api.MysqlDataScript
+	cluster *api.MysqlCluster
+
+	namespace string
+
+	client   kubernetes.Interface
+	myClient ticlientset.Interface
+	mgr      *manager.ClusterManager
+}
+
+// New creates a new MysqlDataScript factory. mgr is the shared
+// ClusterManager; when it has already polled the target cluster,
+// resolveHosts prefers its cached Master/HealthyReplica lookups over
+// querying orchestrator synchronously. mgr may be nil, in which case
+// resolveHosts always falls back to the synchronous cluster helpers.
+func New(script *api.MysqlDataScript, cluster *api.MysqlCluster, klient kubernetes.Interface,
+	myClient ticlientset.Interface, ns string, mgr *manager.ClusterManager) Interface {
+	return &dFactory{
+		script:    script,
+		cluster:   cluster,
+		client:    klient,
+		myClient:  myClient,
+		namespace: ns,
+		mgr:       mgr,
+	}
+}
+
+func (f *dFactory) Sync(ctx context.Context) error {
+	sql, statements, err := f.resolveStatements(ctx)
+	if err != nil {
+		f.script.SetCondition(api.DataScriptConditionFailed, metav1.ConditionTrue, "ResolveStatementsFailed", err.Error())
+		return err
+	}
+
+	if err := f.script.Spec.ValidateStatements(statements); err != nil {
+		f.script.SetCondition(api.DataScriptConditionFailed, metav1.ConditionTrue, "ValidationFailed", err.Error())
+		return err
+	}
+
+	hosts, err := f.resolveHosts()
+	if err != nil {
+		f.script.SetCondition(api.DataScriptConditionFailed, metav1.ConditionTrue, "ResolveHostsFailed", err.Error())
+		return err
+	}
+
+	secret, err := f.ensureScriptSecret(ctx, sql)
+	if err != nil {
+		f.script.SetCondition(api.DataScriptConditionFailed, metav1.ConditionTrue, "ScriptSecretFailed", err.Error())
+		return err
+	}
+
+	f.script.SetCondition(api.DataScriptConditionProgressing, metav1.ConditionTrue, "RunningJob", "")
+
+	for _, host := range hosts {
+		job := f.jobFor(host, secret.Name)
+		created, err := f.client.BatchV1().Jobs(f.namespace).Create(ctx, job, metav1.CreateOptions{})
+		if err != nil {
+			if !apierrors.IsAlreadyExists(err) {
+				f.script.SetCondition(api.DataScriptConditionFailed, metav1.ConditionTrue, "JobCreateFailed", err.Error())
+				return fmt.Errorf("creating job for host %s: %s", host, err)
+			}
+			created, err = f.client.BatchV1().Jobs(f.namespace).Get(ctx, job.Name, metav1.GetOptions{})
+			if err != nil {
+				f.script.SetCondition(api.DataScriptConditionFailed, metav1.ConditionTrue, "JobCreateFailed", err.Error())
+				return fmt.Errorf("reading existing job for host %s: %s", host, err)
+			}
+		}
+		f.recordExecution(host, statements, created)
+		glog.V(2).Infof("[mysqldatascript/%s]: launched job %s for host %s", f.script.Name, job.Name, host)
+	}
+
+	f.script.SetCondition(api.DataScriptConditionProgressing, metav1.ConditionFalse, "JobsLaunched", "")
+	f.script.SetCondition(api.DataScriptConditionSucceeded, metav1.ConditionTrue, "JobsLaunched", "")
+	return nil
+}
+
+// resolveHosts expands Spec.Target into the concrete pod hostnames the
+// script should run against. For Master/RandomReplica it prefers the
+// manager's cached view (populated by its own poll loop, not this call)
+// over GetMasterHost/GetHealtySlaveHost, which hit orchestrator
+// synchronously; those remain the fallback for when the manager hasn't
+// polled this cluster yet.
+func (f *dFactory) resolveHosts() ([]string, error) {
+	name := types.NamespacedName{Name: f.cluster.Name, Namespace: f.cluster.Namespace}
+
+	switch f.script.Spec.GetTarget() {
+	case api.TargetMaster:
+		if f.mgr != nil {
+			if host, ok := f.mgr.Master(name); ok {
+				return []string{host}, nil
+			}
+		}
+		return []string{f.cluster.GetMasterHost()}, nil
+	case api.TargetRandomReplica:
+		if f.mgr != nil {
+			if host, ok := f.mgr.HealthyReplica(name); ok {
+				return []string{host}, nil
+			}
+		}
+		return []string{f.cluster.GetHealtySlaveHost()}, nil
+	case api.TargetAllReplicas:
+		hosts := make([]string, 0, f.cluster.Status.ReadyNodes)
+		for i := 0; i < int(f.cluster.Status.ReadyNodes); i++ {
+			hosts = append(hosts, f.cluster.GetPodHostName(i))
+		}
+		return hosts, nil
+	default:
+		return nil, fmt.Errorf("unknown target %q", f.script.Spec.Target)
+	}
+}
+
+// resolveStatements reads the script's SQL from whichever source was
+// configured. It returns both the raw SQL (written verbatim into the
+// Secret the job mounts) and the statement-split form, used only for
+// ValidateStatements.
+func (f *dFactory) resolveStatements(ctx context.Context) (string, []string, error) {
+	sources := 0
+	if len(f.script.Spec.Script) != 0 {
+		sources++
+	}
+	if f.script.Spec.ConfigMapRef != nil {
+		sources++
+	}
+	if f.script.Spec.SecretRef != nil {
+		sources++
+	}
+	if sources != 1 {
+		return "", nil, fmt.Errorf("exactly one of script, configMapRef or secretRef must be set, got %d", sources)
+	}
+
+	sql := f.script.Spec.Script
+
+	if f.script.Spec.ConfigMapRef != nil {
+		cm, err := f.client.CoreV1().ConfigMaps(f.namespace).Get(ctx, f.script.Spec.ConfigMapRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", nil, fmt.Errorf("reading configMapRef %s: %s", f.script.Spec.ConfigMapRef.Name, err)
+		}
+		for _, v := range cm.Data {
+			sql += "\n" + v
+		}
+	}
+
+	if f.script.Spec.SecretRef != nil {
+		secret, err := f.client.CoreV1().Secrets(f.namespace).Get(ctx, f.script.Spec.SecretRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", nil, fmt.Errorf("reading secretRef %s: %s", f.script.Spec.SecretRef.Name, err)
+		}
+		for _, v := range secret.Data {
+			sql += "\n" + string(v)
+		}
+	}
+
+	statements := []string{}
+	for _, stmt := range strings.Split(sql, ";") {
+		if trimmed := strings.TrimSpace(stmt); len(trimmed) != 0 {
+			statements = append(statements, trimmed)
+		}
+	}
+	return sql, statements, nil
+}
+
+func (f *dFactory) scriptSecretName() string {
+	return fmt.Sprintf("%s-script", f.script.Name)
+}
+
+// ensureScriptSecret writes sql into the Secret the job mounts, so the
+// resolved text (inline, ConfigMapRef or SecretRef) actually reaches the
+// run-script container instead of being discarded after validation. A
+// Secret is used rather than a ConfigMap because the resolved SQL can
+// itself carry credentials, e.g. the ALTER USER statements cFactory's
+// rotateCredentials runs through here.
+func (f *dFactory) ensureScriptSecret(ctx context.Context, sql string) (*core.Secret, error) {
+	secret := &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            f.scriptSecretName(),
+			Namespace:       f.namespace,
+			Labels:          f.cluster.GetLabels(),
+			OwnerReferences: []metav1.OwnerReference{f.script.AsOwnerReference()},
+		},
+		Data: map[string][]byte{
+			scriptFileName: []byte(sql),
+		},
+	}
+
+	existing, err := f.client.CoreV1().Secrets(f.namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return f.client.CoreV1().Secrets(f.namespace).Create(ctx, secret, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting script secret %s: %s", secret.Name, err)
+	}
+
+	existing.Data = secret.Data
+	return f.client.CoreV1().Secrets(f.namespace).Update(ctx, existing, metav1.UpdateOptions{})
+}
+
+// recordExecution records (or updates) this script's execution against
+// host in Status.Executions, from the Job's own status. Per-statement
+// success/failure isn't separately observable here — the run-script
+// container doesn't report back per-statement — so every statement in a
+// completed job is marked with the job's overall outcome.
+func (f *dFactory) recordExecution(host string, statements []string, job *batch.Job) {
+	outcomes := make([]api.StatementOutcome, len(statements))
+	for i, stmt := range statements {
+		outcomes[i] = api.StatementOutcome{Statement: stmt}
+	}
+
+	execution := api.MysqlDataScriptExecution{
+		Host:       host,
+		StartedAt:  job.CreationTimestamp,
+		Statements: outcomes,
+	}
+
+	for _, c := range job.Status.Conditions {
+		switch {
+		case c.Type == batch.JobComplete && c.Status == core.ConditionTrue:
+			finishedAt := c.LastTransitionTime
+			execution.FinishedAt = &finishedAt
+			for i := range execution.Statements {
+				execution.Statements[i].Succeeded = true
+			}
+		case c.Type == batch.JobFailed && c.Status == core.ConditionTrue:
+			finishedAt := c.LastTransitionTime
+			execution.FinishedAt = &finishedAt
+			for i := range execution.Statements {
+				execution.Statements[i].Error = c.Message
+			}
+		}
+	}
+
+	for i, e := range f.script.Status.Executions {
+		if e.Host == host {
+			f.script.Status.Executions[i] = execution
+			return
+		}
+	}
+	f.script.Status.Executions = append(f.script.Status.Executions, execution)
+}
+
+func (f *dFactory) jobName(host string) string {
+	return fmt.Sprintf("%s-%s", f.script.Name, strings.SplitN(host, ".", 2)[0])
+}
+
+// jobFor builds the short-lived Job that connects to host with the
+// cluster's credentials, mounts scriptSecret and streams the script's SQL
+// file into it.
+func (f *dFactory) jobFor(host, scriptSecret string) *batch.Job {
+	backoffLimit := int32(0)
+
+	return &batch.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            f.jobName(host),
+			Namespace:       f.namespace,
+			Labels:          f.cluster.GetLabels(),
+			OwnerReferences: []metav1.OwnerReference{f.script.AsOwnerReference()},
+		},
+		Spec: batch.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: f.script.Spec.TTLSecondsAfterFinished,
+			Template: core.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: f.cluster.GetLabels(),
+				},
+				Spec: core.PodSpec{
+					RestartPolicy: core.RestartPolicyNever,
+					Volumes: []core.Volume{
+						{
+							Name: scriptVolumeName,
+							VolumeSource: core.VolumeSource{
+								Secret: &core.SecretVolumeSource{
+									SecretName: scriptSecret,
+								},
+							},
+						},
+					},
+					Containers: []core.Container{
+						{
+							Name:  "run-script",
+							Image: f.script.GetHelperImage(),
+							Command: []string{
+								"mysql-helper", "run-script",
+								"--host", host,
+								"--database", f.script.Spec.Database,
+								"--script-path", fmt.Sprintf("%s/%s", scriptMountPath, scriptFileName),
+							},
+							EnvFrom: []core.EnvFromSource{
+								{SecretRef: &core.SecretEnvSource{LocalObjectReference: core.LocalObjectReference{Name: f.cluster.Spec.SecretName}}},
+							},
+							VolumeMounts: []core.VolumeMount{
+								{Name: scriptVolumeName, MountPath: scriptMountPath, ReadOnly: true},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dbop pools direct MySQL connections to cluster hosts, so the
+// cluster manager can poll replication status without dialing a fresh
+// connection on every tick.
+package dbop
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// Pool caches one *sql.DB per DSN.
+type Pool struct {
+	mu    sync.Mutex
+	conns map[string]*sql.DB
+}
+
+// NewPool creates an empty connection pool.
+func NewPool() *Pool {
+	return &Pool{conns: make(map[string]*sql.DB)}
+}
+
+// Get returns the pooled *sql.DB for dsn, opening (but not connecting;
+// database/sql dials lazily) one if this is the first request for it.
+func (p *Pool) Get(dsn string) (*sql.DB, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if db, ok := p.conns[dsn]; ok {
+		return db, nil
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("dbop: opening %s: %s", dsn, err)
+	}
+	db.SetMaxOpenConns(2)
+	p.conns[dsn] = db
+	return db, nil
+}
+
+// SlaveStatus is the subset of `SHOW SLAVE STATUS` columns the manager needs.
+type SlaveStatus struct {
+	SecondsBehindMaster  sql.NullInt64
+	SlaveIOAndSQLRunning bool
+}
+
+// ShowSlaveStatus runs `SHOW SLAVE STATUS` against the pooled connection for
+// dsn and returns the columns this package cares about.
+func (p *Pool) ShowSlaveStatus(dsn string) (*SlaveStatus, error) {
+	db, err := p.Get(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return nil, fmt.Errorf("dbop: SHOW SLAVE STATUS: %s", err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("dbop: reading columns: %s", err)
+	}
+
+	if !rows.Next() {
+		return nil, fmt.Errorf("dbop: SHOW SLAVE STATUS returned no rows, host is not a replica")
+	}
+
+	values := make([]interface{}, len(cols))
+	for i := range values {
+		values[i] = new(sql.RawBytes)
+	}
+	if err := rows.Scan(values...); err != nil {
+		return nil, fmt.Errorf("dbop: scanning SHOW SLAVE STATUS: %s", err)
+	}
+
+	status := &SlaveStatus{}
+	for i, col := range cols {
+		raw := values[i].(*sql.RawBytes)
+		switch col {
+		case "Seconds_Behind_Master":
+			if len(*raw) != 0 {
+				var n int64
+				if _, err := fmt.Sscanf(string(*raw), "%d", &n); err == nil {
+					status.SecondsBehindMaster = sql.NullInt64{Int64: n, Valid: true}
+				}
+			}
+		case "Slave_IO_Running":
+			status.SlaveIOAndSQLRunning = status.SlaveIOAndSQLRunning || string(*raw) == "Yes"
+		case "Slave_SQL_Running":
+			status.SlaveIOAndSQLRunning = status.SlaveIOAndSQLRunning && string(*raw) == "Yes"
+		}
+	}
+
+	return status, nil
+}
+
+// CloseAll closes every pooled connection. Call it when the owning cluster
+// is deleted.
+func (p *Pool) CloseAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for dsn, db := range p.conns {
+		db.Close()
+		delete(p.conns, dsn)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2018 Pressinfra SRL
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rclone wraps the subset of the rclone CLI the operator shells out
+// to for listing and pruning objects on a configured remote.
+package rclone
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// Object mirrors the subset of `rclone lsjson` output the operator reads.
+type Object struct {
+	Path    string    `json:"Path"`
+	ModTime time.Time `json:"ModTime"`
+}
+
+// List returns the objects under remote, using the rclone config at configPath.
+func List(configPath, remote string) ([]Object, error) {
+	out, err := exec.Command("rclone", "--config", configPath, "lsjson", remote).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+	if err := json.Unmarshal(out, &objects); err != nil {
+		return nil, fmt.Errorf("parsing rclone lsjson output: %s", err)
+	}
+	return objects, nil
+}
+
+// Remove deletes the single object at path.
+func Remove(configPath, path string) error {
+	return exec.Command("rclone", "--config", configPath, "deletefile", path).Run()
+}
+
+// Copy downloads the single object at remotePath into localDir, using the
+// rclone config at configPath.
+func Copy(configPath, remotePath, localDir string) error {
+	return exec.Command("rclone", "--config", configPath, "copy", remotePath, localDir).Run()
+}